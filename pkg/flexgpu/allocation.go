@@ -0,0 +1,244 @@
+package flexgpu
+
+import (
+	"context"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+// gpuAllocationGVR identifies the GPUAllocation CRD: a namespaced, one-per-pod
+// record of a pod's gpu reservation, written by Reserve ahead of Bind so
+// concurrent scheduling cycles can see the reservation before the pod's own
+// GPUIndexAnnotationKey annotation is reflected back by the API server.
+var gpuAllocationGVR = schema.GroupVersionResource{
+	Group:    "flex.com",
+	Version:  "v1",
+	Resource: "gpuallocations",
+}
+
+// allocationNodeIndex indexes GPUAllocation objects by spec.node, so Filter,
+// Score and Reserve can look reservations up for a node straight out of the
+// informer cache instead of issuing a live, cluster-wide List per call.
+const allocationNodeIndex = "node"
+
+// allocationGCInterval is how often the garbage collector sweeps for
+// GPUAllocation objects whose owning pod has been deleted.
+const allocationGCInterval = time.Minute
+
+// gpuAllocation mirrors the spec of a GPUAllocation object, plus the owning
+// pod's namespace/name so NewGPUNode can dedupe against live pods.
+type gpuAllocation struct {
+	namespace      string
+	name           string
+	node           string
+	indices        []int
+	memoryPerIndex *resource.Quantity
+	compute        *resource.Quantity
+	// computePolicy is ComputePolicyFixedShare or ComputePolicyBurstShare, so
+	// the allocation union in setPodUsage can tell which usage bucket
+	// compute belongs in, the same way it does for live pods.
+	computePolicy string
+}
+
+// allocationLister serves GPUAllocation lookups by node out of a dynamic
+// informer's local cache, wired up once in New rather than re-listed on
+// every Filter/Score/Reserve call.
+type allocationLister struct {
+	informer cache.SharedIndexInformer
+}
+
+// newAllocationLister starts a dynamic informer for the GPUAllocation GVR and
+// waits for its initial sync. The factory it builds is self-contained (it is
+// not part of h.SharedInformerFactory(), which only knows built-in types), so
+// it owns and runs its own goroutine for the lifetime of the process.
+func newAllocationLister(client dynamic.Interface) *allocationLister {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	informer := factory.ForResource(gpuAllocationGVR).Informer()
+	if err := informer.AddIndexers(cache.Indexers{
+		allocationNodeIndex: func(obj interface{}) ([]string, error) {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return nil, nil
+			}
+			spec, ok := u.Object["spec"].(map[string]interface{})
+			if !ok {
+				return nil, nil
+			}
+			node, _ := spec["node"].(string)
+			if node == "" {
+				return nil, nil
+			}
+			return []string{node}, nil
+		},
+	}); err != nil {
+		klog.Warningf("failed to index GPUAllocation informer by node: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	return &allocationLister{informer: informer}
+}
+
+// listForNode returns the outstanding GPUAllocation objects targeting
+// nodeName out of the informer cache. Malformed objects are skipped with a
+// warning rather than failing the scheduling cycle.
+func (l *allocationLister) listForNode(nodeName string) []gpuAllocation {
+	items, err := l.informer.GetIndexer().ByIndex(allocationNodeIndex, nodeName)
+	if err != nil {
+		klog.V(4).InfoS("indexed GPUAllocation lookup failed", "node", nodeName, "err", err)
+		return nil
+	}
+
+	var allocations []gpuAllocation
+	for _, obj := range items {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+
+		spec, ok := u.Object["spec"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		a, err := parseGPUAllocationSpec(spec)
+		if err != nil {
+			klog.Warningf("skipping malformed GPUAllocation %s/%s: %v", u.GetNamespace(), u.GetName(), err)
+			continue
+		}
+
+		a.namespace = u.GetNamespace()
+		a.name = u.GetName()
+		a.node = nodeName
+		allocations = append(allocations, a)
+	}
+	return allocations
+}
+
+// writeGPUAllocation persists a pod's reservation as a GPUAllocation named
+// after the pod, in the pod's namespace, creating or updating it as needed.
+func writeGPUAllocation(ctx context.Context, client dynamic.Interface, pod *v1.Pod, nodeName string, indices []int, memoryPerIndex, compute *resource.Quantity, computePolicy string) error {
+	rawIndices := make([]interface{}, len(indices))
+	for i, index := range indices {
+		rawIndices[i] = int64(index)
+	}
+
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "flex.com/v1",
+			"kind":       "GPUAllocation",
+			"metadata": map[string]interface{}{
+				"name":      pod.Name,
+				"namespace": pod.Namespace,
+				"ownerReferences": []interface{}{
+					map[string]interface{}{
+						"apiVersion": "v1",
+						"kind":       "Pod",
+						"name":       pod.Name,
+						"uid":        string(pod.UID),
+					},
+				},
+			},
+			"spec": map[string]interface{}{
+				"node":           nodeName,
+				"indices":        rawIndices,
+				"memoryPerIndex": memoryPerIndex.String(),
+				"compute":        compute.String(),
+				"computePolicy":  computePolicy,
+			},
+		},
+	}
+
+	_, err := client.Resource(gpuAllocationGVR).Namespace(pod.Namespace).Create(ctx, obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = client.Resource(gpuAllocationGVR).Namespace(pod.Namespace).Update(ctx, obj, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// deleteGPUAllocation removes the GPUAllocation named after pod, ignoring a
+// not-found error since Unreserve may race with the gc loop or pod deletion.
+func deleteGPUAllocation(ctx context.Context, client dynamic.Interface, pod *v1.Pod) error {
+	err := client.Resource(gpuAllocationGVR).Namespace(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func parseGPUAllocationSpec(spec map[string]interface{}) (gpuAllocation, error) {
+	var a gpuAllocation
+
+	rawIndices, _ := spec["indices"].([]interface{})
+	for _, raw := range rawIndices {
+		switch v := raw.(type) {
+		case int64:
+			a.indices = append(a.indices, int(v))
+		case float64:
+			a.indices = append(a.indices, int(v))
+		default:
+			return a, fmt.Errorf("unexpected index element type %T", raw)
+		}
+	}
+
+	memStr, _ := spec["memoryPerIndex"].(string)
+	mem, err := resource.ParseQuantity(memStr)
+	if err != nil {
+		return a, fmt.Errorf("parsing memoryPerIndex %q: %w", memStr, err)
+	}
+	a.memoryPerIndex = &mem
+
+	computeStr, _ := spec["compute"].(string)
+	compute, err := resource.ParseQuantity(computeStr)
+	if err != nil {
+		return a, fmt.Errorf("parsing compute %q: %w", computeStr, err)
+	}
+	a.compute = &compute
+
+	policy, _ := spec["computePolicy"].(string)
+	if policy == ComputePolicyBurstShare {
+		a.computePolicy = ComputePolicyBurstShare
+	} else {
+		a.computePolicy = ComputePolicyFixedShare
+	}
+
+	return a, nil
+}
+
+// runAllocationGC starts a goroutine that periodically removes GPUAllocation
+// objects whose owning pod no longer exists, as a backstop to owner-reference
+// garbage collection.
+func runAllocationGC(ctx context.Context, client dynamic.Interface, podLister corelisters.PodLister) {
+	go wait.Until(func() {
+		list, err := client.Resource(gpuAllocationGVR).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			klog.V(4).InfoS("listing GPUAllocations for gc failed", "err", err)
+			return
+		}
+
+		for i := range list.Items {
+			item := &list.Items[i]
+			if _, err := podLister.Pods(item.GetNamespace()).Get(item.GetName()); err == nil {
+				continue
+			}
+
+			if err := client.Resource(gpuAllocationGVR).Namespace(item.GetNamespace()).Delete(ctx, item.GetName(), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				klog.Warningf("gc: failed to delete GPUAllocation %s/%s: %v", item.GetNamespace(), item.GetName(), err)
+			}
+		}
+	}, allocationGCInterval, ctx.Done())
+}
@@ -0,0 +1,66 @@
+package flexgpu
+
+import "testing"
+
+// TestParseGPUAllocationSpec covers the GPUAllocation spec decoding used by
+// allocationLister.listForNode, including the computePolicy field and its
+// ComputePolicyFixedShare fallback for allocations written before the field
+// existed.
+func TestParseGPUAllocationSpec(t *testing.T) {
+	spec := map[string]interface{}{
+		"indices":        []interface{}{int64(0), int64(1)},
+		"memoryPerIndex": "1000",
+		"compute":        "50",
+		"computePolicy":  ComputePolicyBurstShare,
+	}
+
+	a, err := parseGPUAllocationSpec(spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(a.indices) != 2 || a.indices[0] != 0 || a.indices[1] != 1 {
+		t.Fatalf("unexpected indices: %v", a.indices)
+	}
+	if a.memoryPerIndex.CmpInt64(1000) != 0 {
+		t.Fatalf("unexpected memoryPerIndex: %v", a.memoryPerIndex)
+	}
+	if a.computePolicy != ComputePolicyBurstShare {
+		t.Fatalf("want computePolicy %q, got %q", ComputePolicyBurstShare, a.computePolicy)
+	}
+}
+
+// TestParseGPUAllocationSpecDefaultsComputePolicy covers an allocation
+// object with no computePolicy field, e.g. one written before the field
+// existed: it must fall back to ComputePolicyFixedShare rather than an
+// empty/unrecognized policy.
+func TestParseGPUAllocationSpecDefaultsComputePolicy(t *testing.T) {
+	spec := map[string]interface{}{
+		"indices":        []interface{}{float64(0)},
+		"memoryPerIndex": "1000",
+		"compute":        "50",
+	}
+
+	a, err := parseGPUAllocationSpec(spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a.computePolicy != ComputePolicyFixedShare {
+		t.Fatalf("want computePolicy to default to %q, got %q", ComputePolicyFixedShare, a.computePolicy)
+	}
+}
+
+// TestParseGPUAllocationSpecMalformed covers the error paths: a bad index
+// element type and an unparsable quantity.
+func TestParseGPUAllocationSpecMalformed(t *testing.T) {
+	if _, err := parseGPUAllocationSpec(map[string]interface{}{
+		"indices": []interface{}{"not-an-int"},
+	}); err == nil {
+		t.Fatalf("want error for non-numeric index element")
+	}
+
+	if _, err := parseGPUAllocationSpec(map[string]interface{}{
+		"memoryPerIndex": "not-a-quantity",
+	}); err == nil {
+		t.Fatalf("want error for unparsable memoryPerIndex")
+	}
+}
@@ -0,0 +1,60 @@
+package flexgpu
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"time"
+)
+
+// ScoreStrategy selects how FlexGPU.Score ranks candidate nodes.
+type ScoreStrategy string
+
+const (
+	// ScoreStrategyBinPack prefers nodes with the least remaining memory,
+	// measured before the pod's own request is placed, packing pods onto
+	// already-busy nodes.
+	ScoreStrategyBinPack ScoreStrategy = "binpack"
+	// ScoreStrategySpread prefers nodes with the most free full gpus.
+	ScoreStrategySpread ScoreStrategy = "spread"
+	// ScoreStrategyDotProduct scores by the cosine similarity between the
+	// pod's (memory, compute) request vector and the node's remaining
+	// capacity vector, favoring balanced utilization across the fleet.
+	ScoreStrategyDotProduct ScoreStrategy = "dotproduct"
+)
+
+// ResourceWeights lets operators nudge memory-heavy or compute-heavy pods
+// onto different nodes under ScoreStrategyDotProduct.
+type ResourceWeights struct {
+	Memory  int64
+	Compute int64
+}
+
+// Args configures the FlexGPU plugin, passed as the pluginConfig.args of the
+// scheduler configuration and decoded into New.
+type Args struct {
+	metav1.TypeMeta
+
+	Strategy ScoreStrategy
+	Weights  ResourceWeights
+
+	// HandshakeTTL is how stale a node's nvidia.flex.com/handshake
+	// annotation may be before the node is treated as having no live
+	// device plugin and is filtered out.
+	HandshakeTTL metav1.Duration
+}
+
+func (a *Args) DeepCopyObject() runtime.Object {
+	if a == nil {
+		return nil
+	}
+	cp := *a
+	return &cp
+}
+
+func defaultArgs() *Args {
+	return &Args{
+		Strategy:     ScoreStrategyBinPack,
+		Weights:      ResourceWeights{Memory: 1, Compute: 1},
+		HandshakeTTL: metav1.Duration{Duration: 5 * time.Minute},
+	}
+}
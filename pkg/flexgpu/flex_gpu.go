@@ -7,20 +7,65 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/scheduler/framework"
 	"strconv"
+	"strings"
 )
 
 const (
-	Name                  = "FlexGPU"
-	GPUResourceName       = "nvidia.flex.com/gpu"
-	MemResourceName       = "nvidia.flex.com/memory"
-	GPUIndexAnnotationKey = "nvidia.flex.com/index"
+	Name                     = "FlexGPU"
+	GPUResourceName          = "nvidia.flex.com/gpu"
+	MemResourceName          = "nvidia.flex.com/memory"
+	ComputeResourceName      = "nvidia.flex.com/compute"
+	GPUIndexAnnotationKey    = "nvidia.flex.com/index"
+	GPUDevicesAnnotationKey  = "nvidia.flex.com/devices"
+	GPUModelSelectorKey      = "nvidia.flex.com/gpu-model"
+	GPUTopologyAnnotationKey = "nvidia.flex.com/topology"
+
+	ComputePolicyAnnotationKey = "nvidia.flex.com/compute-policy"
+	ComputePolicyFixedShare    = "fixed-share"
+	ComputePolicyBurstShare    = "burst-share"
+
+	IndexAffinityAnnotationKey = "nvidia.flex.com/index-affinity"
+	IndexAffinityBinPack       = "bin-pack"
+	IndexAffinitySpread        = "spread"
 )
 
+// podGPUModelSelector returns the GPU model a pod wants to be scheduled onto,
+// or "" if the pod does not constrain its placement. The selector may be set
+// either as a pod annotation or as a nodeSelector-style label.
+func podGPUModelSelector(pod *v1.Pod) string {
+	if model, ok := pod.Annotations[GPUModelSelectorKey]; ok {
+		return model
+	}
+	return pod.Labels[GPUModelSelectorKey]
+}
+
+// podComputePolicy returns the compute sharing policy requested by a pod via
+// ComputePolicyAnnotationKey, defaulting to ComputePolicyFixedShare.
+func podComputePolicy(pod *v1.Pod) string {
+	if policy, ok := pod.Annotations[ComputePolicyAnnotationKey]; ok && policy == ComputePolicyBurstShare {
+		return ComputePolicyBurstShare
+	}
+	return ComputePolicyFixedShare
+}
+
+// podIndexAffinity returns the within-node index sort order requested by a
+// pod via IndexAffinityAnnotationKey, defaulting to IndexAffinityBinPack.
+func podIndexAffinity(pod *v1.Pod) string {
+	if affinity, ok := pod.Annotations[IndexAffinityAnnotationKey]; ok && affinity == IndexAffinitySpread {
+		return IndexAffinitySpread
+	}
+	return IndexAffinityBinPack
+}
+
 type FlexGPU struct {
-	handle framework.Handle
+	handle        framework.Handle
+	args          *Args
+	dynamicClient dynamic.Interface
+	allocations   *allocationLister
 }
 
 var _ framework.FilterPlugin = &FlexGPU{}
@@ -32,9 +77,49 @@ func (f FlexGPU) Name() string {
 	return Name
 }
 
-// New initializes a new plugin and returns it.
-func New(_ runtime.Object, h framework.Handle) (framework.Plugin, error) {
-	return &FlexGPU{handle: h}, nil
+// New initializes a new plugin and returns it. obj, when non-nil, must be a
+// *Args decoded from the plugin's pluginConfig.args.
+func New(obj runtime.Object, h framework.Handle) (framework.Plugin, error) {
+	args := defaultArgs()
+	if obj != nil {
+		a, ok := obj.(*Args)
+		if !ok {
+			return nil, fmt.Errorf("want args to be of type *Args, got %T", obj)
+		}
+		args = a
+
+		// A decoded Args is trusted verbatim for Strategy, whose zero value
+		// "" already degrades safely into the binpack case in Score's
+		// switch. HandshakeTTL and Weights have no such safe zero value, so
+		// an operator supplying a partial config (e.g. only Strategy) must
+		// not silently get ttl=0 (every node looks stale) or zero weights
+		// (the request vector has a zero norm, so DotProductScore scores
+		// every node 0).
+		if args.HandshakeTTL.Duration == 0 {
+			args.HandshakeTTL = defaultArgs().HandshakeTTL
+		}
+		if args.Weights == (ResourceWeights{}) {
+			args.Weights = defaultArgs().Weights
+		}
+	}
+
+	// Watch for device plugins going away via the shared node informer and
+	// mark their handshake deleted; Filter still checks each node's
+	// handshake age itself.
+	newHandshakeController(h, args.HandshakeTTL.Duration)
+
+	dynamicClient, err := dynamic.NewForConfig(h.KubeConfig())
+	if err != nil {
+		return nil, fmt.Errorf("building dynamic client: %w", err)
+	}
+
+	runAllocationGC(context.Background(), dynamicClient, h.SharedInformerFactory().Core().V1().Pods().Lister())
+
+	// Serve GPUAllocation lookups out of an informer cache instead of a live
+	// List per Filter/Score/Reserve call.
+	allocations := newAllocationLister(dynamicClient)
+
+	return &FlexGPU{handle: h, args: args, dynamicClient: dynamicClient, allocations: allocations}, nil
 }
 
 func (f FlexGPU) Filter(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeInfo *framework.NodeInfo) *framework.Status {
@@ -50,15 +135,11 @@ func (f FlexGPU) Filter(ctx context.Context, state *framework.CycleState, pod *v
 
 	gpuLimit, gpuLimitExist := podResourceLimit(GPUResourceName, pod)
 	memLimit, memLimitExist := podResourceLimit(MemResourceName, pod)
-	if !gpuLimitExist && !memLimitExist {
+	computeLimit, computeLimitExist := podResourceLimit(ComputeResourceName, pod)
+	if !gpuLimitExist && !memLimitExist && !computeLimitExist {
 		return nil
 	}
 
-	if gpuLimitExist && memLimitExist {
-		klog.Warningf("pod conflict resources %s and %s", GPUResourceName, MemResourceName)
-		return framework.NewStatus(framework.UnschedulableAndUnresolvable, "pod conflict resources")
-	}
-
 	// return if unknown resource type
 	gpuAllocatable, ok := nodeInfo.Node().Status.Allocatable[GPUResourceName]
 	if !ok {
@@ -96,8 +177,16 @@ func (f FlexGPU) Filter(ctx context.Context, state *framework.CycleState, pod *v
 		return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("insufficient resource %v", MemResourceName))
 	}
 
+	if stale, reason := isHandshakeStale(nodeInfo.Node(), f.args.HandshakeTTL.Duration); stale {
+		return framework.NewStatus(framework.UnschedulableAndUnresolvable, reason)
+	}
+
+	if unhealthy, reason := allDevicesUnhealthy(nodeInfo.Node()); unhealthy {
+		return framework.NewStatus(framework.UnschedulableAndUnresolvable, reason)
+	}
+
 	// filter out possible fit gpus
-	no := NewGPUNode(nodeInfo)
+	no := NewGPUNode(nodeInfo, f.allocations.listForNode(nodeInfo.Node().Name))
 
 	if klog.V(6).Enabled() {
 		for _, u := range no.gpus {
@@ -105,12 +194,19 @@ func (f FlexGPU) Filter(ctx context.Context, state *framework.CycleState, pod *v
 		}
 	}
 
-	if memLimitExist {
-		indexes := no.MemAssumeFitIndexes(memLimit)
+	modelSelector := podGPUModelSelector(pod)
+
+	if gpuLimitExist {
+		sets := no.GPUAssumeFitIndexes(gpuLimit, modelSelector)
+		if len(sets) == 0 {
+			return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("no fit indexes resource %v", GPUResourceName))
+		}
+	} else if memLimitExist || computeLimitExist {
+		indexes := no.SharedAssumeFitIndexes(memLimit, computeLimit, podComputePolicy(pod), podIndexAffinity(pod), modelSelector)
 
 		klog.V(6).InfoS("fit indexes", "indexes", indexes)
 		if len(indexes) == 0 {
-			return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("no fit indexes resource %v", MemResourceName))
+			return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("no fit indexes resource %v/%v", MemResourceName, ComputeResourceName))
 		}
 	}
 
@@ -129,6 +225,16 @@ func podResourceLimit(name v1.ResourceName, pod *v1.Pod) (*resource.Quantity, bo
 	return resourceLimitSum, exist
 }
 
+// joinIndexes renders a set of gpu indices as the comma-separated list
+// stored in GPUIndexAnnotationKey.
+func joinIndexes(indexes []int) string {
+	parts := make([]string, len(indexes))
+	for i, index := range indexes {
+		parts[i] = strconv.Itoa(index)
+	}
+	return strings.Join(parts, ",")
+}
+
 func nodeResourceLimitSum(name v1.ResourceName, nodeInfo *framework.NodeInfo) *resource.Quantity {
 	resourceLimitSum := resource.NewQuantity(0, resource.DecimalSI)
 	for _, podInfo := range nodeInfo.Pods {
@@ -144,10 +250,77 @@ func (f FlexGPU) Score(ctx context.Context, state *framework.CycleState, pod *v1
 			klog.V(6).InfoS("resource limit", "point", "score", k, v.AsDec().String())
 		}
 	}
-	return 0, nil
+
+	gpuLimit, gpuLimitExist := podResourceLimit(GPUResourceName, pod)
+	memLimit, _ := podResourceLimit(MemResourceName, pod)
+	computeLimit, _ := podResourceLimit(ComputeResourceName, pod)
+	if !gpuLimitExist && memLimit.IsZero() && computeLimit.IsZero() {
+		return 0, nil
+	}
+
+	nodeInfo, err := f.handle.SnapshotSharedLister().NodeInfos().Get(nodeName)
+	if err != nil {
+		return 0, framework.NewStatus(framework.Error, fmt.Sprintf("getting node %q from Snapshot: %v", nodeName, err))
+	}
+
+	no := NewGPUNode(nodeInfo, f.allocations.listForNode(nodeName))
+	modelSelector := podGPUModelSelector(pod)
+
+	var topoScore int64
+	if gpuLimitExist {
+		sets := no.GPUAssumeFitIndexes(gpuLimit, modelSelector)
+		if len(sets) == 0 {
+			return 0, nil
+		}
+		topoScore = no.TopologyScore(sets[0])
+	}
+
+	var strategyScore int64
+	switch f.args.Strategy {
+	case ScoreStrategySpread:
+		strategyScore = no.GPUScore()
+	case ScoreStrategyDotProduct:
+		strategyScore = no.DotProductScore(memLimit, computeLimit, f.args.Weights)
+	default:
+		strategyScore = no.BinPackScore()
+	}
+
+	return topoScore + strategyScore, nil
 }
 
+// ScoreExtensions returns f itself: FlexGPU also implements NormalizeScore,
+// which rescales the raw scores from Score (a topology bonus plus a strategy
+// score, whose sum can exceed MaxNodeScore) into the framework's
+// [0, MaxNodeScore] range.
 func (f FlexGPU) ScoreExtensions() framework.ScoreExtensions {
+	return f
+}
+
+func (f FlexGPU) NormalizeScore(ctx context.Context, state *framework.CycleState, pod *v1.Pod, scores framework.NodeScoreList) *framework.Status {
+	if len(scores) == 0 {
+		return nil
+	}
+
+	minScore, maxScore := scores[0].Score, scores[0].Score
+	for _, s := range scores {
+		if s.Score < minScore {
+			minScore = s.Score
+		}
+		if s.Score > maxScore {
+			maxScore = s.Score
+		}
+	}
+
+	if maxScore == minScore {
+		for i := range scores {
+			scores[i].Score = framework.MaxNodeScore
+		}
+		return nil
+	}
+
+	for i := range scores {
+		scores[i].Score = (scores[i].Score - minScore) * framework.MaxNodeScore / (maxScore - minScore)
+	}
 	return nil
 }
 
@@ -159,39 +332,52 @@ func (f FlexGPU) Reserve(ctx context.Context, state *framework.CycleState, p *v1
 
 	gpuLimit, gpuLimitExist := podResourceLimit(GPUResourceName, p)
 	memLimit, memLimitExist := podResourceLimit(MemResourceName, p)
+	computeLimit, computeLimitExist := podResourceLimit(ComputeResourceName, p)
 
-	if !gpuLimitExist && !memLimitExist {
+	if !gpuLimitExist && !memLimitExist && !computeLimitExist {
 		return nil
 	}
 
-	if gpuLimitExist && memLimitExist {
-		return framework.NewStatus(framework.UnschedulableAndUnresolvable, "pod conflict resources")
-	}
-
-	no := NewGPUNode(nodeInfo)
+	no := NewGPUNode(nodeInfo, f.allocations.listForNode(nodeName))
+	modelSelector := podGPUModelSelector(p)
 
 	if gpuLimitExist {
-		indexes := no.GPUAssumeFitIndexes(gpuLimit)
-		if len(indexes) == 0 {
+		sets := no.GPUAssumeFitIndexes(gpuLimit, modelSelector)
+		if len(sets) == 0 {
 			return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("allocate index fail %v", GPUResourceName))
 		}
 		if p.Annotations == nil {
 			p.Annotations = make(map[string]string)
 		}
-		p.Annotations[GPUIndexAnnotationKey] = strconv.Itoa(indexes[0])
-	}
+		p.Annotations[GPUIndexAnnotationKey] = joinIndexes(sets[0])
 
-	if memLimitExist {
-		indexes := no.MemAssumeFitIndexes(memLimit)
+		memPerIndex := resource.NewQuantity(0, resource.DecimalSI)
+		if g := no.gpuByIndex(sets[0][0]); g != nil {
+			memPerIndex = g.memory
+		}
+		if err := writeGPUAllocation(ctx, f.dynamicClient, p, nodeName, sets[0], memPerIndex, resource.NewQuantity(fullComputeCapacity, resource.DecimalSI), ComputePolicyFixedShare); err != nil {
+			// Without a persisted GPUAllocation, the double-booking protection
+			// this CRD exists for is silently gone; fail the reservation
+			// rather than let the scheduler proceed as if it were recorded.
+			return framework.NewStatus(framework.Error, fmt.Sprintf("persisting GPUAllocation for pod %s: %v", klog.KObj(p), err))
+		}
+	} else if memLimitExist || computeLimitExist {
+		indexes := no.SharedAssumeFitIndexes(memLimit, computeLimit, podComputePolicy(p), podIndexAffinity(p), modelSelector)
 		if len(indexes) == 0 {
-			return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("allocate index fail %v", MemResourceName))
+			return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("allocate index fail %v/%v", MemResourceName, ComputeResourceName))
 		}
 		if p.Annotations == nil {
 			p.Annotations = make(map[string]string)
 		}
-		// indexes is sorted by bin-pack affinity
-		// TODO: maybe provide spread affinity
+		// indexes is sorted per IndexAffinityAnnotationKey (bin-pack or spread)
 		p.Annotations[GPUIndexAnnotationKey] = strconv.Itoa(indexes[0])
+
+		if err := writeGPUAllocation(ctx, f.dynamicClient, p, nodeName, []int{indexes[0]}, memLimit, computeLimit, podComputePolicy(p)); err != nil {
+			// Without a persisted GPUAllocation, the double-booking protection
+			// this CRD exists for is silently gone; fail the reservation
+			// rather than let the scheduler proceed as if it were recorded.
+			return framework.NewStatus(framework.Error, fmt.Sprintf("persisting GPUAllocation for pod %s: %v", klog.KObj(p), err))
+		}
 	}
 
 	klog.V(6).InfoS("annotations", "annotations", p.Annotations)
@@ -201,6 +387,10 @@ func (f FlexGPU) Reserve(ctx context.Context, state *framework.CycleState, p *v1
 func (f FlexGPU) Unreserve(ctx context.Context, state *framework.CycleState, p *v1.Pod, nodeName string) {
 	klog.V(6).InfoS("unreserve", "annotations", p.Annotations)
 	delete(p.Annotations, GPUIndexAnnotationKey)
+
+	if err := deleteGPUAllocation(ctx, f.dynamicClient, p); err != nil {
+		klog.Warningf("failed to delete GPUAllocation for pod %s: %v", klog.KObj(p), err)
+	}
 }
 
 func (f FlexGPU) Bind(ctx context.Context, state *framework.CycleState, p *v1.Pod, nodeName string) *framework.Status {
@@ -0,0 +1,52 @@
+package flexgpu
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+)
+
+// TestNormalizeScoreRescalesToMaxNodeScore guards NormalizeScore's min-max
+// rescale of the raw scores Score returns (topology bonus plus strategy
+// score, whose sum can exceed MaxNodeScore) into the framework's
+// [0, MaxNodeScore] range.
+func TestNormalizeScoreRescalesToMaxNodeScore(t *testing.T) {
+	f := FlexGPU{}
+	scores := framework.NodeScoreList{
+		{Name: "a", Score: 10},
+		{Name: "b", Score: 30},
+		{Name: "c", Score: 50},
+	}
+
+	if status := f.NormalizeScore(nil, nil, nil, scores); !status.IsSuccess() {
+		t.Fatalf("unexpected status: %v", status)
+	}
+
+	if scores[0].Score != 0 {
+		t.Fatalf("want min score rescaled to 0, got %d", scores[0].Score)
+	}
+	if scores[2].Score != framework.MaxNodeScore {
+		t.Fatalf("want max score rescaled to %d, got %d", framework.MaxNodeScore, scores[2].Score)
+	}
+	if scores[1].Score != framework.MaxNodeScore/2 {
+		t.Fatalf("want midpoint score rescaled to %d, got %d", framework.MaxNodeScore/2, scores[1].Score)
+	}
+}
+
+// TestNormalizeScoreAllEqual guards the degenerate case where every node
+// scored the same: without this branch the rescale below divides by
+// maxScore-minScore == 0.
+func TestNormalizeScoreAllEqual(t *testing.T) {
+	f := FlexGPU{}
+	scores := framework.NodeScoreList{{Name: "a", Score: 5}, {Name: "b", Score: 5}}
+
+	if status := f.NormalizeScore(nil, nil, nil, scores); !status.IsSuccess() {
+		t.Fatalf("unexpected status: %v", status)
+	}
+
+	for _, s := range scores {
+		if s.Score != framework.MaxNodeScore {
+			t.Fatalf("want every tied node to get %d, got %d", framework.MaxNodeScore, s.Score)
+		}
+	}
+}
@@ -1,33 +1,68 @@
 package flexgpu
 
 import (
+	"encoding/json"
 	"fmt"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"math"
 	"sort"
 	"strconv"
+	"strings"
 )
 
+// fullComputeCapacity is the compute fraction, out of 100, a single gpu
+// provides when shared via nvidia.flex.com/compute.
+const fullComputeCapacity = 100
+
 type gpuNode struct {
 	gpuCount    *resource.Quantity
 	memoryTotal *resource.Quantity
 	gpus        []*gpu
+	// topology groups indices of gpus that share an NVLink/PCIe switch, e.g.
+	// groups of 4 or 8 GPUs. A gpu index not present in any group is treated
+	// as its own singleton group.
+	topology [][]int
 }
 
 type gpu struct {
 	index      int
+	model      string
 	monopoly   bool
+	healthy    bool
 	memory     *resource.Quantity
 	usedMemory *resource.Quantity
+	// compute is the allocatable compute fraction of the gpu, 0-100.
+	compute *resource.Quantity
+	// usedCompute tracks fixed-share compute already handed out on this gpu
+	// and counts against SharedAssumeFitIndexes. burstCompute tracks
+	// burst-share compute, which is recorded for co-tenancy affinity but
+	// never counted against the fit check.
+	usedCompute  *resource.Quantity
+	burstCompute *resource.Quantity
 }
 
 func (u *gpu) String() string {
-	return fmt.Sprintf("gpu: { index: %v, monopoly: %v, memory: %v, usedMemory: %v }", u.index, u.monopoly, u.memory, u.usedMemory)
+	return fmt.Sprintf("gpu: { index: %v, model: %v, monopoly: %v, healthy: %v, memory: %v, usedMemory: %v, compute: %v, usedCompute: %v, burstCompute: %v }",
+		u.index, u.model, u.monopoly, u.healthy, u.memory, u.usedMemory, u.compute, u.usedCompute, u.burstCompute)
+}
+
+// deviceEntry is a single element of the nvidia.flex.com/devices node
+// annotation, written by the device plugin to describe the actual GPUs
+// present on the node.
+type deviceEntry struct {
+	Index       int    `json:"index"`
+	Model       string `json:"model"`
+	MemoryBytes int64  `json:"memoryBytes"`
+	Healthy     bool   `json:"healthy"`
 }
 
-func NewGPUNode(nodeInfo *framework.NodeInfo) *gpuNode {
+// NewGPUNode builds a gpuNode from nodeInfo's live pods unioned with
+// allocations, the outstanding GPUAllocation reservations for this node not
+// yet reflected in nodeInfo (see gpuAllocation).
+func NewGPUNode(nodeInfo *framework.NodeInfo, allocations []gpuAllocation) *gpuNode {
 
 	var pods []*v1.Pod
 	for _, po := range nodeInfo.Pods {
@@ -48,53 +83,164 @@ func NewGPUNode(nodeInfo *framework.NodeInfo) *gpuNode {
 		panic("invalid memory resource format")
 	}
 
-	// assume all gpu in one node is same model.
-	// TODO: support heterogeneous gpus in one node.
-	// TODO: maybe by let device plugin add annotation to node automatically.
-	klog.V(6).InfoS("calculate", "memory", memCnt, "gpu", gpuCnt)
-	memEachGPU := resource.NewQuantity(memCnt/gpuCnt, resource.DecimalSI)
-	klog.V(6).InfoS("memory each gpu", "memory", memEachGPU.String())
+	var gpus []*gpu
+	if raw, ok := nodeInfo.Node().Annotations[GPUDevicesAnnotationKey]; ok {
+		devices, err := parseDeviceEntries(raw)
+		if err != nil {
+			klog.Warningf("node %s invalid %s annotation: %v", nodeInfo.Node().Name, GPUDevicesAnnotationKey, err)
+		} else {
+			gpus = constructGPUsFromDevices(devices, pods, allocations)
+		}
+	}
+
+	if gpus == nil {
+		// assume all gpu in one node is same model.
+		klog.V(6).InfoS("calculate", "memory", memCnt, "gpu", gpuCnt)
+		memEachGPU := resource.NewQuantity(memCnt/gpuCnt, resource.DecimalSI)
+		klog.V(6).InfoS("memory each gpu", "memory", memEachGPU.String())
+
+		gpus = constructGPUs(int(gpuCnt), memEachGPU, pods, allocations)
+	}
 
-	gpus := constructGPUs(int(gpuCnt), memEachGPU, pods)
+	var topology [][]int
+	if raw, ok := nodeInfo.Node().Annotations[GPUTopologyAnnotationKey]; ok {
+		groups, err := parseTopologyGroups(raw)
+		if err != nil {
+			klog.Warningf("node %s invalid %s annotation: %v", nodeInfo.Node().Name, GPUTopologyAnnotationKey, err)
+		} else {
+			topology = groups
+		}
+	}
 
 	return &gpuNode{
 		gpuCount:    &gpuAllocatable,
 		memoryTotal: &memAllocatable,
 		gpus:        gpus,
+		topology:    topology,
+	}
+}
+
+// parseTopologyGroups decodes the nvidia.flex.com/topology node annotation,
+// a JSON array of gpu index groups that share an NVLink/PCIe switch.
+func parseTopologyGroups(raw string) ([][]int, error) {
+	var groups [][]int
+	if err := json.Unmarshal([]byte(raw), &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// groupID returns a identifier for the topology group containing index. GPUs
+// not covered by the topology annotation are each their own singleton group,
+// identified by a negative id unique to that index.
+func (n *gpuNode) groupID(index int) int {
+	for gid, group := range n.topology {
+		for _, idx := range group {
+			if idx == index {
+				return gid
+			}
+		}
+	}
+	return -(index + 1)
+}
+
+// groupSize returns the number of gpus sharing the topology group identified
+// by gid, as returned by groupID.
+func (n *gpuNode) groupSize(gid int) int {
+	if gid < 0 {
+		return 1
+	}
+	return len(n.topology[gid])
+}
+
+// gpuByIndex returns the gpu with the given index, or nil if not found.
+func (n *gpuNode) gpuByIndex(index int) *gpu {
+	for _, u := range n.gpus {
+		if u.index == index {
+			return u
+		}
+	}
+	return nil
+}
+
+// parseDeviceEntries decodes the nvidia.flex.com/devices node annotation,
+// a JSON array describing each physical GPU reported by the device plugin.
+func parseDeviceEntries(raw string) ([]deviceEntry, error) {
+	var devices []deviceEntry
+	if err := json.Unmarshal([]byte(raw), &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func constructGPUsFromDevices(devices []deviceEntry, pods []*v1.Pod, allocations []gpuAllocation) []*gpu {
+	gpus := make([]*gpu, len(devices))
+	for i, d := range devices {
+		gpus[i] = &gpu{
+			index:        d.Index,
+			model:        d.Model,
+			monopoly:     false,
+			healthy:      d.Healthy,
+			memory:       resource.NewQuantity(d.MemoryBytes, resource.DecimalSI),
+			usedMemory:   resource.NewQuantity(0, resource.DecimalSI),
+			compute:      resource.NewQuantity(fullComputeCapacity, resource.DecimalSI),
+			usedCompute:  resource.NewQuantity(0, resource.DecimalSI),
+			burstCompute: resource.NewQuantity(0, resource.DecimalSI),
+		}
 	}
+	setPodUsage(gpus, pods, allocations)
+	return gpus
 }
 
-func constructGPUs(cnt int, memEachGPU *resource.Quantity, pods []*v1.Pod) []*gpu {
+func constructGPUs(cnt int, memEachGPU *resource.Quantity, pods []*v1.Pod, allocations []gpuAllocation) []*gpu {
 	gpus := make([]*gpu, cnt)
 	for i := 0; i < cnt; i++ {
+		// each gpu needs its own Quantity; sharing memEachGPU's pointer would
+		// let one gpu's in-place Add/Sub bleed into every other gpu's capacity.
+		mem := memEachGPU.DeepCopy()
 		gpus[i] = &gpu{
-			index:      i,
-			monopoly:   false,
-			memory:     memEachGPU,
-			usedMemory: resource.NewQuantity(0, resource.DecimalSI),
+			index:        i,
+			monopoly:     false,
+			healthy:      true,
+			memory:       &mem,
+			usedMemory:   resource.NewQuantity(0, resource.DecimalSI),
+			compute:      resource.NewQuantity(fullComputeCapacity, resource.DecimalSI),
+			usedCompute:  resource.NewQuantity(0, resource.DecimalSI),
+			burstCompute: resource.NewQuantity(0, resource.DecimalSI),
 		}
 	}
 
+	setPodUsage(gpus, pods, allocations)
+	return gpus
+}
+
+// setPodUsage accounts for the GPU/memory limits of already-running pods
+// against the gpus they were assigned to via GPUIndexAnnotationKey, then
+// unions in any outstanding GPUAllocation reservations not already reflected
+// by one of those pods, so a reservation is visible to other scheduling
+// cycles before the pod's own annotations land in the API server.
+func setPodUsage(gpus []*gpu, pods []*v1.Pod, allocations []gpuAllocation) {
+	byIndex := make(map[int]*gpu, len(gpus))
+	for _, u := range gpus {
+		byIndex[u.index] = u
+	}
+
+	seen := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		seen[pod.Namespace+"/"+pod.Name] = true
+	}
+
 	for _, pod := range pods {
 		gpuLimit, gpuExist := podResourceLimit(GPUResourceName, pod)
-		if gpuExist && gpuLimit.CmpInt64(1) != 0 {
-			klog.Warningf("pod %s resource %s limit %s invalid", pod.Name, GPUResourceName, gpuLimit.String())
-		}
 		memLimit, memExist := podResourceLimit(MemResourceName, pod)
+		computeLimit, computeExist := podResourceLimit(ComputeResourceName, pod)
 
-		if !gpuExist && !memExist {
+		if !gpuExist && !memExist && !computeExist {
 			klog.V(6).InfoS("skip", "pod", klog.KObj(pod))
 			continue
 		}
 
-		klog.V(6).InfoS("set monopoly", "pod", klog.KObj(pod))
 		val, hasAnnotation := pod.ObjectMeta.Annotations[GPUIndexAnnotationKey]
-		index, err := strconv.Atoi(val)
-		if err != nil {
-			klog.Warningf("pod %s invalid index annotation %s", pod.Name, val)
-			continue
-		}
-
 		if !hasAnnotation {
 			if !gpuLimit.IsZero() {
 				klog.Warningf("pod %s no index annotation with %s limit set", pod.Name, GPUResourceName)
@@ -102,54 +248,160 @@ func constructGPUs(cnt int, memEachGPU *resource.Quantity, pods []*v1.Pod) []*gp
 			if !memLimit.IsZero() {
 				klog.Warningf("pod %s no index annotation with %s limit set", pod.Name, MemResourceName)
 			}
+			if !computeLimit.IsZero() {
+				klog.Warningf("pod %s no index annotation with %s limit set", pod.Name, ComputeResourceName)
+			}
+			continue
+		}
+
+		indices, err := parseIndexList(val)
+		if err != nil {
+			klog.Warningf("pod %s invalid index annotation %s: %v", pod.Name, val, err)
 			continue
 		}
 
-		if gpuExist {
-			klog.V(6).InfoS("set monopoly", "pod", klog.KObj(pod))
-			gpus[index].monopoly = true
+		if gpuExist && int64(len(indices)) != gpuLimit.Value() {
+			klog.Warningf("pod %s resource %s limit %s does not match index annotation %s", pod.Name, GPUResourceName, gpuLimit.String(), val)
 		}
 
-		if memExist {
-			klog.V(6).InfoS("add memory", "pod", klog.KObj(pod))
-			gpus[index].usedMemory.Add(*memLimit)
+		for _, index := range indices {
+			u, ok := byIndex[index]
+			if !ok {
+				klog.Warningf("pod %s index annotation %d not found on node", pod.Name, index)
+				continue
+			}
+
+			if gpuExist {
+				klog.V(6).InfoS("set monopoly", "pod", klog.KObj(pod))
+				u.monopoly = true
+			}
+
+			if memExist {
+				klog.V(6).InfoS("add memory", "pod", klog.KObj(pod))
+				u.usedMemory.Add(*memLimit)
+			}
+
+			if computeExist {
+				if podComputePolicy(pod) == ComputePolicyBurstShare {
+					klog.V(6).InfoS("add burst compute", "pod", klog.KObj(pod))
+					u.burstCompute.Add(*computeLimit)
+				} else {
+					klog.V(6).InfoS("add compute", "pod", klog.KObj(pod))
+					u.usedCompute.Add(*computeLimit)
+				}
+			}
 		}
 	}
 
-	return gpus
+	for _, a := range allocations {
+		if seen[a.namespace+"/"+a.name] {
+			// already counted above via the pod's own annotations
+			continue
+		}
+
+		for _, index := range a.indices {
+			u, ok := byIndex[index]
+			if !ok {
+				klog.Warningf("GPUAllocation %s/%s index %d not found on node", a.namespace, a.name, index)
+				continue
+			}
+
+			u.usedMemory.Add(*a.memoryPerIndex)
+			if a.computePolicy == ComputePolicyBurstShare {
+				u.burstCompute.Add(*a.compute)
+			} else {
+				u.usedCompute.Add(*a.compute)
+			}
+			if a.compute.CmpInt64(fullComputeCapacity) >= 0 {
+				u.monopoly = true
+			}
+		}
+	}
 }
 
-func (n *gpuNode) MemAssumeFitIndexes(memLimit *resource.Quantity) []int {
+// parseIndexList parses the comma-separated gpu indices stored in
+// GPUIndexAnnotationKey, e.g. "0,1,2,3".
+func parseIndexList(val string) ([]int, error) {
+	parts := strings.Split(val, ",")
+	indices := make([]int, 0, len(parts))
+	for _, p := range parts {
+		index, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+// SharedAssumeFitIndexes returns the indexes of gpus that could accommodate a
+// shared (memory, compute) allocation, sorted by affinity (bin-pack prefers
+// least remaining memory first, spread prefers most remaining memory first).
+// When model is non-empty, only gpus of that model are considered. Under
+// policy ComputePolicyBurstShare, computeLimit is not counted against a
+// gpu's usedCompute for fit purposes, but gpus already hosting burst tenants
+// are preferred so bursty co-tenants land together.
+func (n *gpuNode) SharedAssumeFitIndexes(memLimit, computeLimit *resource.Quantity, policy string, affinity string, model string) []int {
 	type fit struct {
-		index  int
-		remain *resource.Quantity
+		index       int
+		remain      *resource.Quantity
+		burstTenant bool
 	}
 
+	countCompute := policy != ComputePolicyBurstShare
+
 	var fits []fit
 	for _, u := range n.gpus {
-		if u.monopoly && u.usedMemory.CmpInt64(0) != 0 {
-			klog.Warningf("conflict resource %s and %s on gpu index %d", GPUResourceName, MemResourceName, u.index)
+		if model != "" && u.model != model {
+			continue
 		}
 
-		assumed := u.usedMemory
-		assumed.Add(*memLimit)
-		if !u.monopoly && u.memory.Cmp(*assumed) >= 0 {
-			klog.V(6).InfoS("possible fit", "index", u.index)
+		if !u.healthy {
+			continue
+		}
 
-			remain := u.memory
-			remain.Sub(*assumed)
-			f := fit{
-				index:  u.index,
-				remain: remain,
-			}
+		if u.monopoly {
+			continue
+		}
+
+		// copy rather than alias usedMemory/memory: Add/Sub mutate their
+		// receiver in place, so working on the gpu's own Quantities here
+		// would change its recorded usage or capacity for every later fit
+		// check.
+		assumedMem := u.usedMemory.DeepCopy()
+		assumedMem.Add(*memLimit)
+		if u.memory.Cmp(assumedMem) < 0 {
+			continue
+		}
 
-			fits = append(fits, f)
+		if countCompute {
+			assumedCompute := u.usedCompute.DeepCopy()
+			assumedCompute.Add(*computeLimit)
+			if u.compute.Cmp(assumedCompute) < 0 {
+				continue
+			}
 		}
+
+		klog.V(6).InfoS("possible fit", "index", u.index)
+
+		remain := u.memory.DeepCopy()
+		remain.Sub(assumedMem)
+		fits = append(fits, fit{
+			index:       u.index,
+			remain:      &remain,
+			burstTenant: !u.burstCompute.IsZero(),
+		})
 	}
 
-	// sort to perform bin-pack affinity
-	// TODO: maybe provide spread affinity
+	// sort by bin-pack or spread affinity, preferring existing burst tenants
+	// when the incoming pod is itself bursty
 	sort.Slice(fits, func(i, j int) bool {
+		if policy == ComputePolicyBurstShare && fits[i].burstTenant != fits[j].burstTenant {
+			return fits[i].burstTenant
+		}
+		if affinity == IndexAffinitySpread {
+			return fits[i].remain.Cmp(*fits[j].remain) > 0
+		}
 		return fits[i].remain.Cmp(*fits[j].remain) < 0
 	})
 
@@ -160,36 +412,131 @@ func (n *gpuNode) MemAssumeFitIndexes(memLimit *resource.Quantity) []int {
 	return indexes
 }
 
-func (n *gpuNode) GPUAssumeFitIndexes(gpuLimit *resource.Quantity) []int {
+// GPUAssumeFitIndexes returns candidate sets of gpuLimit free gpu indices for
+// monopoly allocation, sorted to prefer sets that fit entirely inside the
+// smallest containing topology group. When model is non-empty, only gpus of
+// that model are considered.
+func (n *gpuNode) GPUAssumeFitIndexes(gpuLimit *resource.Quantity, model string) [][]int {
+	cnt, ok := gpuLimit.AsInt64()
+	if !ok || cnt <= 0 {
+		return nil
+	}
+	count := int(cnt)
 
-	var fits []int
+	freeByGroup := make(map[int][]int)
+	var free []int
 	for _, u := range n.gpus {
+		if model != "" && u.model != model {
+			continue
+		}
+
+		if !u.healthy {
+			continue
+		}
+
 		if u.monopoly && u.usedMemory.CmpInt64(0) != 0 {
 			klog.Warningf("conflict resource %s and %s on gpu index %d", GPUResourceName, MemResourceName, u.index)
 		}
 
-		if !u.monopoly && u.usedMemory.IsZero() {
+		if !u.monopoly && u.usedMemory.IsZero() && u.usedCompute.IsZero() && u.burstCompute.IsZero() {
 			klog.V(6).InfoS("possible fit", "index", u.index)
-			fits = append(fits, u.index)
+			gid := n.groupID(u.index)
+			freeByGroup[gid] = append(freeByGroup[gid], u.index)
+			free = append(free, u.index)
+		}
+	}
+
+	type candidate struct {
+		indices   []int
+		groupSize int
+	}
+
+	var candidates []candidate
+	for gid, indices := range freeByGroup {
+		if len(indices) < count {
+			continue
 		}
+		candidates = append(candidates, candidate{
+			indices:   append([]int(nil), indices[:count]...),
+			groupSize: n.groupSize(gid),
+		})
 	}
+
+	// prefer the smallest containing group, i.e. the tightest interconnect
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].groupSize < candidates[j].groupSize
+	})
+
+	var fits [][]int
+	for _, c := range candidates {
+		fits = append(fits, c.indices)
+	}
+
+	if len(fits) == 0 && len(free) >= count {
+		// no single topology group has enough free gpus; fall back to an
+		// arbitrary allocation spanning groups.
+		fits = append(fits, append([]int(nil), free[:count]...))
+	}
+
 	return fits
 }
 
+// TopologyScore returns a scoring bonus favoring allocations of indices that
+// sit inside a small, fully shared topology group.
+func (n *gpuNode) TopologyScore(indices []int) int64 {
+	if len(indices) == 0 {
+		return 0
+	}
+
+	gid := n.groupID(indices[0])
+	for _, index := range indices[1:] {
+		if n.groupID(index) != gid {
+			return 0
+		}
+	}
+
+	if gid < 0 {
+		return 0
+	}
+
+	groupSize := n.groupSize(gid)
+	if groupSize == 0 {
+		return 0
+	}
+
+	return int64(len(indices)) * framework.MaxNodeScore / int64(groupSize)
+}
+
+// GPUScore favors nodes with more free full gpus, scaled to
+// [0, framework.MaxNodeScore] so it stays comparable to TopologyScore when
+// Score sums the two.
 func (n *gpuNode) GPUScore() int64 {
+	if len(n.gpus) == 0 {
+		return 0
+	}
+
 	cnt := 0
 	for _, u := range n.gpus {
-		if !u.monopoly && u.usedMemory.IsZero() {
+		if !u.monopoly && u.usedMemory.IsZero() && u.usedCompute.IsZero() && u.burstCompute.IsZero() {
 			cnt++
 		}
 	}
-	return int64(cnt)
+	return int64(cnt) * framework.MaxNodeScore / int64(len(n.gpus))
 }
 
+// MemScore returns the total remaining memory across the node's
+// non-monopoly gpus. A monopoly gpu is claimed whole by a gpu=N pod; for a
+// live gpu=N pod without a memory limit setPodUsage sets only the monopoly
+// bool and leaves usedMemory at 0, so it must be excluded here the same way GPUScore/remainingCompute already
+// exclude monopoly gpus, or BinPackScore/DotProductScore would see a fully
+// consumed node as fully free.
 func (n *gpuNode) MemScore() int64 {
 	remainSum := resource.NewQuantity(0, resource.DecimalSI)
 
 	for _, u := range n.gpus {
+		if u.monopoly {
+			continue
+		}
 		remainSum.Add(*u.memory)
 		remainSum.Sub(*u.usedMemory)
 	}
@@ -197,3 +544,57 @@ func (n *gpuNode) MemScore() int64 {
 	rs, _ := remainSum.AsInt64()
 	return rs
 }
+
+// remainingCompute returns the total unreserved compute fraction across the
+// node's non-monopoly gpus.
+func (n *gpuNode) remainingCompute() int64 {
+	var sum int64
+	for _, u := range n.gpus {
+		if u.monopoly {
+			continue
+		}
+		compute, _ := u.compute.AsInt64()
+		used, _ := u.usedCompute.AsInt64()
+		sum += compute - used
+	}
+	return sum
+}
+
+// BinPackScore favors nodes with the least remaining memory, i.e. the inverse
+// of MemScore; the incoming pod's own request is not added, so the score
+// reflects the node's usage before placement. It is scaled to
+// [0, framework.MaxNodeScore] so it stays comparable to TopologyScore when
+// Score sums the two (MemScore/BinPackScore's raw unit is bytes, orders of
+// magnitude larger than a bounded score).
+func (n *gpuNode) BinPackScore() int64 {
+	total, ok := n.memoryTotal.AsInt64()
+	if !ok || total == 0 {
+		return 0
+	}
+
+	used := total - n.MemScore()
+	return used * framework.MaxNodeScore / total
+}
+
+// DotProductScore scores the node by the cosine similarity between the
+// pod's weighted (memory, compute) request vector and the node's remaining
+// (memory, compute) capacity vector. Balanced nodes whose remaining capacity
+// mix matches the request score highest.
+func (n *gpuNode) DotProductScore(memLimit, computeLimit *resource.Quantity, weights ResourceWeights) int64 {
+	memReq, _ := memLimit.AsInt64()
+	computeReq, _ := computeLimit.AsInt64()
+
+	reqMem := float64(memReq * weights.Memory)
+	reqCompute := float64(computeReq * weights.Compute)
+	remainMem := float64(n.MemScore())
+	remainCompute := float64(n.remainingCompute())
+
+	reqNorm := math.Sqrt(reqMem*reqMem + reqCompute*reqCompute)
+	remainNorm := math.Sqrt(remainMem*remainMem + remainCompute*remainCompute)
+	if reqNorm == 0 || remainNorm == 0 {
+		return 0
+	}
+
+	cosine := (reqMem*remainMem + reqCompute*remainCompute) / (reqNorm * remainNorm)
+	return int64(cosine * float64(framework.MaxNodeScore))
+}
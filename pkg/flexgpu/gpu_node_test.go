@@ -0,0 +1,292 @@
+package flexgpu
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+)
+
+func newFreeGPU(index int, memoryUnits int64) *gpu {
+	return &gpu{
+		index:        index,
+		healthy:      true,
+		memory:       resource.NewQuantity(memoryUnits, resource.DecimalSI),
+		usedMemory:   resource.NewQuantity(0, resource.DecimalSI),
+		compute:      resource.NewQuantity(fullComputeCapacity, resource.DecimalSI),
+		usedCompute:  resource.NewQuantity(0, resource.DecimalSI),
+		burstCompute: resource.NewQuantity(0, resource.DecimalSI),
+	}
+}
+
+// TestSharedAssumeFitIndexesDoesNotShrinkOtherGPUs guards against a bug where
+// evaluating one gpu's fit mutated the Quantity backing a later gpu's
+// capacity via pointer aliasing, wrongly rejecting gpus that were never
+// touched by the request being evaluated.
+func TestSharedAssumeFitIndexesDoesNotShrinkOtherGPUs(t *testing.T) {
+	n := &gpuNode{gpus: []*gpu{newFreeGPU(0, 100), newFreeGPU(1, 100)}}
+
+	memLimit := resource.NewQuantity(60, resource.DecimalSI)
+	computeLimit := resource.NewQuantity(0, resource.DecimalSI)
+
+	indexes := n.SharedAssumeFitIndexes(memLimit, computeLimit, ComputePolicyFixedShare, IndexAffinityBinPack, "")
+
+	if len(indexes) != 2 {
+		t.Fatalf("want both 100-unit gpus to fit a 60-unit request, got indexes %v", indexes)
+	}
+}
+
+// TestConstructGPUsGivesEachGPUItsOwnMemoryQuantity guards against
+// constructGPUs handing every gpu the same *resource.Quantity, which let
+// in-place Add/Sub on one gpu bleed into every other gpu sharing that node.
+func TestConstructGPUsGivesEachGPUItsOwnMemoryQuantity(t *testing.T) {
+	memEachGPU := resource.NewQuantity(100, resource.DecimalSI)
+	gpus := constructGPUs(2, memEachGPU, nil, nil)
+
+	if gpus[0].memory == gpus[1].memory {
+		t.Fatalf("gpus share the same memory Quantity pointer")
+	}
+
+	gpus[0].usedMemory.Add(resource.MustParse("60"))
+	if gpus[1].usedMemory.Cmp(resource.MustParse("0")) != 0 {
+		t.Fatalf("gpu 1 usedMemory affected by gpu 0's usage: %v", gpus[1].usedMemory)
+	}
+}
+
+// TestSharedAssumeFitIndexesSkipsUnhealthyGPU guards against offering an
+// individual unhealthy gpu for allocation on a node where other gpus are
+// still healthy.
+func TestSharedAssumeFitIndexesSkipsUnhealthyGPU(t *testing.T) {
+	unhealthy := newFreeGPU(0, 100)
+	unhealthy.healthy = false
+	healthy := newFreeGPU(1, 100)
+
+	n := &gpuNode{gpus: []*gpu{unhealthy, healthy}}
+
+	memLimit := resource.NewQuantity(10, resource.DecimalSI)
+	computeLimit := resource.NewQuantity(0, resource.DecimalSI)
+
+	indexes := n.SharedAssumeFitIndexes(memLimit, computeLimit, ComputePolicyFixedShare, IndexAffinityBinPack, "")
+
+	if len(indexes) != 1 || indexes[0] != 1 {
+		t.Fatalf("want only the healthy gpu index 1, got %v", indexes)
+	}
+}
+
+// TestBinPackScoreIsBoundedToMaxNodeScore guards against BinPackScore
+// returning a raw byte count, which would swamp TopologyScore (itself bounded
+// to [0, MaxNodeScore]) once Score sums the two.
+func TestBinPackScoreIsBoundedToMaxNodeScore(t *testing.T) {
+	gpus := []*gpu{newFreeGPU(0, 500), newFreeGPU(1, 500)}
+	n := &gpuNode{memoryTotal: resource.NewQuantity(1000, resource.DecimalSI), gpus: gpus}
+
+	if got := n.BinPackScore(); got != 0 {
+		t.Fatalf("want 0 for a fully free node, got %d", got)
+	}
+
+	gpus[0].usedMemory.Add(resource.MustParse("500"))
+	if got, want := n.BinPackScore(), framework.MaxNodeScore/2; got != want {
+		t.Fatalf("want %d for a half-used node, got %d", want, got)
+	}
+}
+
+// TestGPUScoreIsBoundedToMaxNodeScore guards against GPUScore returning an
+// unbounded free-gpu count rather than a value comparable to TopologyScore.
+func TestGPUScoreIsBoundedToMaxNodeScore(t *testing.T) {
+	gpus := []*gpu{newFreeGPU(0, 100), newFreeGPU(1, 100)}
+	n := &gpuNode{gpus: gpus}
+
+	if got, want := n.GPUScore(), framework.MaxNodeScore; got != want {
+		t.Fatalf("want %d for a fully free node, got %d", want, got)
+	}
+
+	gpus[0].monopoly = true
+	if got, want := n.GPUScore(), framework.MaxNodeScore/2; got != want {
+		t.Fatalf("want %d with one gpu occupied, got %d", want, got)
+	}
+}
+
+// TestParseDeviceEntries covers the nvidia.flex.com/devices node annotation
+// format: a JSON array of per-device entries.
+func TestParseDeviceEntries(t *testing.T) {
+	devices, err := parseDeviceEntries(`[{"index":0,"model":"A100","memoryBytes":1000,"healthy":true},{"index":1,"model":"V100","memoryBytes":500,"healthy":false}]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("want 2 devices, got %d", len(devices))
+	}
+	if devices[0].Model != "A100" || devices[0].MemoryBytes != 1000 || !devices[0].Healthy {
+		t.Fatalf("unexpected device 0: %+v", devices[0])
+	}
+	if devices[1].Model != "V100" || devices[1].Healthy {
+		t.Fatalf("unexpected device 1: %+v", devices[1])
+	}
+
+	if _, err := parseDeviceEntries("not json"); err == nil {
+		t.Fatalf("want error for malformed annotation")
+	}
+}
+
+// TestConstructGPUsFromDevices guards the per-device construction path used
+// when a node carries heterogeneous gpus via GPUDevicesAnnotationKey: each
+// gpu must reflect its own model/memory/health rather than the uniform
+// fallback constructGPUs uses when the annotation is absent.
+func TestConstructGPUsFromDevices(t *testing.T) {
+	devices := []deviceEntry{
+		{Index: 0, Model: "A100", MemoryBytes: 1000, Healthy: true},
+		{Index: 1, Model: "V100", MemoryBytes: 500, Healthy: false},
+	}
+
+	gpus := constructGPUsFromDevices(devices, nil, nil)
+
+	if len(gpus) != 2 {
+		t.Fatalf("want 2 gpus, got %d", len(gpus))
+	}
+	if gpus[0].model != "A100" || gpus[0].memory.CmpInt64(1000) != 0 {
+		t.Fatalf("unexpected gpu 0: %+v", gpus[0])
+	}
+	if gpus[1].healthy {
+		t.Fatalf("gpu 1 should be unhealthy per its device entry")
+	}
+}
+
+// TestParseTopologyGroups covers the nvidia.flex.com/topology node
+// annotation format: a JSON array of gpu index groups sharing an NVLink/PCIe
+// switch.
+func TestParseTopologyGroups(t *testing.T) {
+	groups, err := parseTopologyGroups(`[[0,1],[2,3]]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 2 || len(groups[0]) != 2 || groups[1][1] != 3 {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+
+	if _, err := parseTopologyGroups("not json"); err == nil {
+		t.Fatalf("want error for malformed annotation")
+	}
+}
+
+// TestGPUAssumeFitIndexesPrefersSmallestContainingGroup guards the topology
+// grouping that is the point of chunk0-2: a request should be packed into
+// the tightest interconnect that can satisfy it, rather than an arbitrary
+// free set spanning looser or unrelated groups.
+func TestGPUAssumeFitIndexesPrefersSmallestContainingGroup(t *testing.T) {
+	gpus := []*gpu{
+		newFreeGPU(0, 100), newFreeGPU(1, 100), // group of 2
+		newFreeGPU(2, 100), newFreeGPU(3, 100), newFreeGPU(4, 100), newFreeGPU(5, 100), // group of 4
+	}
+	n := &gpuNode{gpus: gpus, topology: [][]int{{0, 1}, {2, 3, 4, 5}}}
+
+	sets := n.GPUAssumeFitIndexes(resource.NewQuantity(2, resource.DecimalSI), "")
+
+	if len(sets) == 0 {
+		t.Fatalf("want at least one candidate set")
+	}
+	want := map[int]bool{0: true, 1: true}
+	for _, idx := range sets[0] {
+		if !want[idx] {
+			t.Fatalf("want the smallest group {0,1} first, got %v", sets[0])
+		}
+	}
+}
+
+// TestGPUAssumeFitIndexesFallsBackAcrossGroups guards the case where no
+// single topology group has enough free gpus: the request must still be
+// satisfied by spanning groups rather than failing outright.
+func TestGPUAssumeFitIndexesFallsBackAcrossGroups(t *testing.T) {
+	gpus := []*gpu{newFreeGPU(0, 100), newFreeGPU(1, 100)}
+	n := &gpuNode{gpus: gpus, topology: [][]int{{0}, {1}}}
+
+	sets := n.GPUAssumeFitIndexes(resource.NewQuantity(2, resource.DecimalSI), "")
+
+	if len(sets) != 1 || len(sets[0]) != 2 {
+		t.Fatalf("want a single 2-gpu fallback set spanning groups, got %v", sets)
+	}
+}
+
+// TestDotProductScoreFavorsMatchingRemainingMix guards the ScoreStrategyDotProduct
+// strategy: a node whose remaining (memory, compute) mix matches the
+// request's weighted mix should score higher than one whose remaining
+// capacity is skewed toward a resource the request doesn't need.
+func TestDotProductScoreFavorsMatchingRemainingMix(t *testing.T) {
+	weights := ResourceWeights{Memory: 1, Compute: 1}
+	memLimit := resource.NewQuantity(50, resource.DecimalSI)
+	computeLimit := resource.NewQuantity(50, resource.DecimalSI)
+
+	balanced := &gpuNode{gpus: []*gpu{newFreeGPU(0, 100)}}
+	balanced.gpus[0].usedCompute.Add(resource.MustParse("0"))
+
+	memSkewed := &gpuNode{gpus: []*gpu{newFreeGPU(0, 100)}}
+	memSkewed.gpus[0].usedCompute.Add(resource.MustParse("100"))
+
+	balancedScore := balanced.DotProductScore(memLimit, computeLimit, weights)
+	skewedScore := memSkewed.DotProductScore(memLimit, computeLimit, weights)
+
+	if balancedScore <= skewedScore {
+		t.Fatalf("want balanced node to outscore a compute-exhausted node, got balanced=%d skewed=%d", balancedScore, skewedScore)
+	}
+}
+
+// TestDotProductScoreZeroNorm guards the degenerate case where the request
+// or the node's remaining capacity is all-zero: cosine similarity is
+// undefined there, and the function must return 0 rather than divide by
+// zero.
+func TestDotProductScoreZeroNorm(t *testing.T) {
+	n := &gpuNode{gpus: []*gpu{newFreeGPU(0, 100)}}
+	zero := resource.NewQuantity(0, resource.DecimalSI)
+
+	if got := n.DotProductScore(zero, zero, ResourceWeights{Memory: 1, Compute: 1}); got != 0 {
+		t.Fatalf("want 0 for an all-zero request, got %d", got)
+	}
+}
+
+// TestSetPodUsageRoutesAllocationComputeByPolicy guards against a
+// GPUAllocation's burst-share reservation being counted against usedCompute
+// (the hard fit-check limit) instead of burstCompute, which would make a
+// co-located burst pod spuriously Unschedulable during the reservation race
+// window the GPUAllocation CRD exists to cover.
+func TestSetPodUsageRoutesAllocationComputeByPolicy(t *testing.T) {
+	gpus := []*gpu{newFreeGPU(0, 100)}
+	alloc := gpuAllocation{
+		namespace:      "ns",
+		name:           "other-pod",
+		indices:        []int{0},
+		memoryPerIndex: resource.NewQuantity(0, resource.DecimalSI),
+		compute:        resource.NewQuantity(50, resource.DecimalSI),
+		computePolicy:  ComputePolicyBurstShare,
+	}
+
+	setPodUsage(gpus, nil, []gpuAllocation{alloc})
+
+	if !gpus[0].usedCompute.IsZero() {
+		t.Fatalf("burst-share allocation counted against usedCompute: %v", gpus[0].usedCompute)
+	}
+	if gpus[0].burstCompute.CmpInt64(50) != 0 {
+		t.Fatalf("burst-share allocation not recorded in burstCompute: %v", gpus[0].burstCompute)
+	}
+}
+
+// TestGPUAssumeFitIndexesSkipsUnhealthyGPU guards against offering an
+// individual unhealthy gpu for monopoly allocation.
+func TestGPUAssumeFitIndexesSkipsUnhealthyGPU(t *testing.T) {
+	unhealthy := newFreeGPU(0, 100)
+	unhealthy.healthy = false
+	healthy := newFreeGPU(1, 100)
+
+	n := &gpuNode{gpus: []*gpu{unhealthy, healthy}}
+
+	sets := n.GPUAssumeFitIndexes(resource.NewQuantity(1, resource.DecimalSI), "")
+
+	if len(sets) == 0 {
+		t.Fatalf("want at least one candidate set")
+	}
+	for _, set := range sets {
+		for _, idx := range set {
+			if idx == 0 {
+				t.Fatalf("unhealthy gpu index 0 offered for allocation: %v", sets)
+			}
+		}
+	}
+}
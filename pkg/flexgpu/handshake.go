@@ -0,0 +1,136 @@
+package flexgpu
+
+import (
+	"context"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"strings"
+	"time"
+)
+
+const (
+	// GPUHandshakeAnnotationKey holds the RFC3339 timestamp the device
+	// plugin last heartbeat to the node.
+	GPUHandshakeAnnotationKey = "nvidia.flex.com/handshake"
+	// handshakeDeletedPrefix marks a handshake annotation the controller has
+	// determined belongs to a device plugin that is no longer present.
+	handshakeDeletedPrefix = "Deleted_"
+)
+
+// isHandshakeStale reports whether node's device plugin handshake is
+// missing, marked deleted, or older than ttl, along with a human-readable
+// reason suitable for a framework.Status.
+func isHandshakeStale(node *v1.Node, ttl time.Duration) (bool, string) {
+	handshake, ok := node.Annotations[GPUHandshakeAnnotationKey]
+	if !ok {
+		return true, fmt.Sprintf("missing %s annotation", GPUHandshakeAnnotationKey)
+	}
+
+	if strings.HasPrefix(handshake, handshakeDeletedPrefix) {
+		return true, fmt.Sprintf("device plugin handshake marked deleted: %s", handshake)
+	}
+
+	ts, err := time.Parse(time.RFC3339, handshake)
+	if err != nil {
+		return true, fmt.Sprintf("invalid %s annotation %q", GPUHandshakeAnnotationKey, handshake)
+	}
+
+	if age := time.Since(ts); age > ttl {
+		return true, fmt.Sprintf("device plugin handshake stale since %s (age %s > ttl %s)", handshake, age, ttl)
+	}
+
+	return false, ""
+}
+
+// allDevicesUnhealthy reports whether node's nvidia.flex.com/devices
+// annotation lists at least one device and every one of them is unhealthy.
+func allDevicesUnhealthy(node *v1.Node) (bool, string) {
+	raw, ok := node.Annotations[GPUDevicesAnnotationKey]
+	if !ok {
+		return false, ""
+	}
+
+	devices, err := parseDeviceEntries(raw)
+	if err != nil || len(devices) == 0 {
+		return false, ""
+	}
+
+	for _, d := range devices {
+		if d.Healthy {
+			return false, ""
+		}
+	}
+
+	return true, fmt.Sprintf("all %d devices reported unhealthy", len(devices))
+}
+
+// isGPUNode reports whether node advertises GPUResourceName or carries the
+// device plugin's GPUDevicesAnnotationKey annotation. Nodes that never ran a device plugin (control-plane, non-GPU workers) must never be
+// touched by the handshake controller.
+func isGPUNode(node *v1.Node) bool {
+	if _, ok := node.Status.Allocatable[GPUResourceName]; ok {
+		return true
+	}
+	if _, ok := node.Annotations[GPUDevicesAnnotationKey]; ok {
+		return true
+	}
+	return false
+}
+
+// handshakeController watches node updates via the shared informer and marks
+// a node's handshake annotation deleted once its device plugin has gone
+// stale, so a crashed or evicted device plugin can't leave behind state that
+// causes bad placements.
+type handshakeController struct {
+	clientset kubernetes.Interface
+	ttl       time.Duration
+}
+
+// newHandshakeController wires a node informer handler off of h's shared
+// informer factory. The factory is started and run by the scheduler
+// framework itself, so this only needs to register the handler.
+func newHandshakeController(h framework.Handle, ttl time.Duration) *handshakeController {
+	c := &handshakeController{clientset: h.ClientSet(), ttl: ttl}
+
+	informer := h.SharedInformerFactory().Core().V1().Nodes().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, newObj interface{}) {
+			c.onNodeUpdate(newObj)
+		},
+	})
+
+	return c
+}
+
+func (c *handshakeController) onNodeUpdate(obj interface{}) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return
+	}
+
+	if !isGPUNode(node) {
+		return
+	}
+
+	stale, reason := isHandshakeStale(node, c.ttl)
+	if !stale {
+		return
+	}
+
+	if handshake := node.Annotations[GPUHandshakeAnnotationKey]; strings.HasPrefix(handshake, handshakeDeletedPrefix) {
+		return
+	}
+
+	klog.InfoS("marking device plugin handshake deleted", "node", node.Name, "reason", reason)
+
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, GPUHandshakeAnnotationKey, handshakeDeletedPrefix+time.Now().Format(time.RFC3339)))
+	if _, err := c.clientset.CoreV1().Nodes().Patch(context.Background(), node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		klog.Warningf("failed to mark node %s device plugin handshake deleted: %v", node.Name, err)
+	}
+}
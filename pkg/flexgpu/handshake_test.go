@@ -0,0 +1,108 @@
+package flexgpu
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+// TestIsGPUNode guards against the handshake controller acting on nodes that
+// never ran a device plugin, e.g. control-plane or non-GPU workers.
+func TestIsGPUNode(t *testing.T) {
+	cases := []struct {
+		name string
+		node *v1.Node
+		want bool
+	}{
+		{
+			name: "plain non-gpu node",
+			node: &v1.Node{},
+			want: false,
+		},
+		{
+			name: "allocatable gpu resource",
+			node: &v1.Node{Status: v1.NodeStatus{Allocatable: v1.ResourceList{
+				v1.ResourceName(GPUResourceName): resource.MustParse("4"),
+			}}},
+			want: true,
+		},
+		{
+			name: "devices annotation",
+			node: &v1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				GPUDevicesAnnotationKey: "[]",
+			}}},
+			want: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isGPUNode(tc.node); got != tc.want {
+				t.Errorf("isGPUNode() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestIsHandshakeStale covers the chunk0-5 staleness rules: missing
+// annotation, the handshakeDeletedPrefix marker, an unparsable timestamp,
+// and ttl expiry.
+func TestIsHandshakeStale(t *testing.T) {
+	ttl := 5 * time.Minute
+
+	cases := []struct {
+		name       string
+		annotation string
+		hasAnn     bool
+		wantStale  bool
+	}{
+		{
+			name:      "missing annotation",
+			hasAnn:    false,
+			wantStale: true,
+		},
+		{
+			name:       "marked deleted",
+			annotation: handshakeDeletedPrefix + "2020-01-01T00:00:00Z",
+			hasAnn:     true,
+			wantStale:  true,
+		},
+		{
+			name:       "invalid timestamp",
+			annotation: "not-a-timestamp",
+			hasAnn:     true,
+			wantStale:  true,
+		},
+		{
+			name:       "fresh handshake",
+			annotation: time.Now().Format(time.RFC3339),
+			hasAnn:     true,
+			wantStale:  false,
+		},
+		{
+			name:       "expired handshake",
+			annotation: time.Now().Add(-10 * time.Minute).Format(time.RFC3339),
+			hasAnn:     true,
+			wantStale:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			node := &v1.Node{}
+			if tc.hasAnn {
+				node.Annotations = map[string]string{GPUHandshakeAnnotationKey: tc.annotation}
+			}
+
+			stale, reason := isHandshakeStale(node, ttl)
+			if stale != tc.wantStale {
+				t.Errorf("isHandshakeStale() = %v (%s), want %v", stale, reason, tc.wantStale)
+			}
+			if stale && reason == "" {
+				t.Errorf("want a non-empty reason when stale")
+			}
+		})
+	}
+}